@@ -0,0 +1,29 @@
+// Copyright 2019 The Fuchsia Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package packages
+
+import (
+	"context"
+	"io/fs"
+
+	"go.fuchsia.dev/fuchsia/src/testing/host-target-testing/build"
+)
+
+// BlobStore is a source of package blobs, addressed by merkle root and,
+// optionally, by delivery blob type (see
+// https://fuchsia.dev/fuchsia-src/concepts/packages/delivery_blob).
+type BlobStore interface {
+	// OpenBlob opens the blob for merkle. If deliveryBlobType is nil, the
+	// blob's uncompressed contents are returned. Otherwise, the blob is
+	// returned encoded as that delivery blob type, if SupportsDeliveryBlobType
+	// reports it's available.
+	OpenBlob(ctx context.Context, deliveryBlobType *int, merkle build.MerkleRoot) (fs.File, error)
+
+	// SupportsDeliveryBlobType reports whether this BlobStore natively
+	// holds blobs encoded as deliveryBlobType, i.e. whether OpenBlob can
+	// serve that type directly rather than a caller having to synthesize
+	// it from another type.
+	SupportsDeliveryBlobType(deliveryBlobType int) bool
+}
@@ -5,26 +5,107 @@
 package packages
 
 import (
+	"bytes"
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
 	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/fs"
+	"math/big"
 	"net"
 	"net/http"
 	"os"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/klauspost/compress/zstd"
 	tuf_data "github.com/theupdateframework/go-tuf/data"
 
 	"go.fuchsia.dev/fuchsia/src/testing/host-target-testing/build"
 	"go.fuchsia.dev/fuchsia/tools/lib/logger"
 )
 
+// ServerConfig describes how to construct a Server. It's the preferred way
+// to start a repository server, since it allows requesting features, such
+// as an HTTPS mirror, without the caller needing to wrap the listener
+// itself.
+type ServerConfig struct {
+	// Dir is the path to the TUF repository to serve.
+	Dir string
+
+	// BlobStore is where blobs referenced by the repository are read from.
+	BlobStore BlobStore
+
+	// LocalHostname is the hostname Server.URL and Server.Hash are rendered
+	// with, and that a generated self-signed certificate is issued for. It's
+	// typically the address the target can reach the host at. The served
+	// config.json instead points at the host each request came in on.
+	LocalHostname string
+
+	// RepoName is the name of the TUF repository, e.g. "devhost".
+	RepoName string
+
+	// RepoPort is the TCP port to listen on. A value of 0 picks a random
+	// free port.
+	RepoPort int
+
+	// RepoOptions controls the storage_type, use_local_mirror and
+	// update_package_url fields advertised in config.json. The zero value
+	// advertises ephemeral, non-local-mirror storage with no update
+	// package URL.
+	RepoOptions RepoOptions
+
+	// TLSConfig, if set, is used to serve the repository and blob mirror
+	// over HTTPS. If nil but UseHTTPS is set, an in-process self-signed
+	// certificate is generated for LocalHostname.
+	TLSConfig *tls.Config
+
+	// UseHTTPS requests that the server listen over HTTPS. It's implied by
+	// setting TLSConfig.
+	UseHTTPS bool
+
+	// DeliveryBlobCacheDir, if set, lets the server synthesize delivery
+	// blob type 1 (zstd-chunked) blobs on the fly for clients that request
+	// them when BlobStore only holds the uncompressed blob, caching the
+	// result under this directory keyed by (type, merkle). Leave unset to
+	// only ever serve whatever delivery blob types BlobStore already has.
+	DeliveryBlobCacheDir string
+}
+
+// Storage types a served config.json can advertise to pkg-resolver, mirroring
+// the modes amberctl's `-p` flag and pmhttp's ConfigServerV2 offer.
+const (
+	StorageTypeEphemeral  repositoryStorageType = "ephemeral"
+	StorageTypePersistent repositoryStorageType = "persistent"
+)
+
+// RepoOptions controls the storage-related fields of a served config.json.
+type RepoOptions struct {
+	// StorageType selects ephemeral or persistent TUF metadata storage.
+	// Defaults to StorageTypeEphemeral.
+	StorageType repositoryStorageType
+
+	// UseLocalMirror tells pkg-resolver to fetch blobs from a local mirror
+	// rather than the mirror_url/blob_mirror_url advertised in config.json.
+	UseLocalMirror bool
+
+	// UpdatePackageURL, if set, points pkg-resolver at a specific update
+	// package to resolve OTAs from.
+	UpdatePackageURL string
+}
+
 type Server struct {
 	Dir          string
 	BlobStore    BlobStore
@@ -37,11 +118,18 @@ type Server struct {
 type httpBlobStore struct {
 	ctx       context.Context
 	blobStore BlobStore
+
+	// deliveryBlobCache holds on-the-fly generated delivery blobs for types
+	// the BlobStore doesn't already have on hand, so they're only produced
+	// once per (type, merkle). It's nil if blob compression wasn't
+	// requested when the httpBlobStore was constructed.
+	deliveryBlobCache *deliveryBlobCache
 }
 
 func (f httpBlobStore) Open(path string) (fs.File, error) {
 	parts := strings.Split(path, "/")
 
+	var file fs.File
 	switch len(parts) {
 	case 2:
 		if parts[0] != "blobs" {
@@ -53,7 +141,10 @@ func (f httpBlobStore) Open(path string) (fs.File, error) {
 			return nil, os.ErrNotExist
 		}
 
-		return f.blobStore.OpenBlob(f.ctx, nil, merkle)
+		file, err = f.blobStore.OpenBlob(f.ctx, nil, merkle)
+		if err != nil {
+			return nil, err
+		}
 	case 3:
 		if parts[0] != "blobs" {
 			return nil, os.ErrNotExist
@@ -71,29 +162,390 @@ func (f httpBlobStore) Open(path string) (fs.File, error) {
 			return nil, os.ErrNotExist
 		}
 
-		return f.blobStore.OpenBlob(f.ctx, deliveryBlobType, merkle)
+		if *deliveryBlobType == deliveryBlobTypeCompressed &&
+			!f.blobStore.SupportsDeliveryBlobType(*deliveryBlobType) &&
+			f.deliveryBlobCache != nil {
+			file, err = f.deliveryBlobCache.openOrCompress(f.ctx, f.blobStore, merkle)
+		} else {
+			file, err = f.blobStore.OpenBlob(f.ctx, deliveryBlobType, merkle)
+		}
+		if err != nil {
+			return nil, err
+		}
 	default:
 		return nil, os.ErrNotExist
 	}
+
+	// http.FileServer needs to seek around the file to serve Range and
+	// If-Range requests, which pkg-resolver relies on when it's already
+	// holding part of a blob. BlobStore implementations don't all return an
+	// fs.File that implements io.Seeker, so wrap it if we can derive
+	// seeking from io.ReaderAt instead.
+	return asSeekableFile(file)
+}
+
+// asSeekableFile returns file unchanged if it already implements
+// io.Seeker, otherwise wraps it in a seeker backed by io.ReaderAt when
+// possible.
+func asSeekableFile(file fs.File) (fs.File, error) {
+	if _, ok := file.(io.Seeker); ok {
+		return file, nil
+	}
+
+	readerAt, ok := file.(io.ReaderAt)
+	if !ok {
+		return file, nil
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	return &seekableFile{File: file, readerAt: readerAt, size: info.Size()}, nil
+}
+
+// seekableFile adapts an fs.File backed by an io.ReaderAt into one that
+// also implements io.Seeker, so it can be served through http.FileServer's
+// Range/If-Range handling.
+type seekableFile struct {
+	fs.File
+	readerAt io.ReaderAt
+	size     int64
+	offset   int64
+}
+
+func (s *seekableFile) Read(p []byte) (int, error) {
+	n, err := s.readerAt.ReadAt(p, s.offset)
+	s.offset += int64(n)
+	return n, err
+}
+
+func (s *seekableFile) Seek(offset int64, whence int) (int64, error) {
+	var newOffset int64
+	switch whence {
+	case io.SeekStart:
+		newOffset = offset
+	case io.SeekCurrent:
+		newOffset = s.offset + offset
+	case io.SeekEnd:
+		newOffset = s.size + offset
+	default:
+		return 0, fmt.Errorf("seekableFile: invalid whence %d", whence)
+	}
+	if newOffset < 0 {
+		return 0, fmt.Errorf("seekableFile: negative position %d", newOffset)
+	}
+	s.offset = newOffset
+	return s.offset, nil
+}
+
+// deliveryBlobTypeCompressed is the delivery blob type pkg-resolver asks
+// for when it wants the chunked, independently-seekable on-disk delivery
+// format (see https://fuchsia.dev/fuchsia-src/concepts/packages/delivery_blob),
+// as opposed to type 0, the uncompressed blob contents.
+const deliveryBlobTypeCompressed = 1
+
+// deliveryBlobCache produces and caches delivery blob type 1 (zstd-chunked)
+// encodings of blobs for BlobStores that only hold the uncompressed
+// contents, so a single blob directory can serve both old clients that
+// fetch uncompressed blobs and newer clients that fetch delivery blobs,
+// without needing a separate pre-generation step.
+type deliveryBlobCache struct {
+	dir string
+}
+
+func newDeliveryBlobCache(dir string) *deliveryBlobCache {
+	return &deliveryBlobCache{dir: dir}
+}
+
+func (c *deliveryBlobCache) path(merkle build.MerkleRoot) string {
+	return filepath.Join(c.dir, strconv.Itoa(deliveryBlobTypeCompressed), hex.EncodeToString(merkle[:]))
+}
+
+// openOrCompress returns the cached type 1 delivery blob for merkle,
+// compressing it from the uncompressed blob in blobStore and populating the
+// cache first if needed.
+func (c *deliveryBlobCache) openOrCompress(ctx context.Context, blobStore BlobStore, merkle build.MerkleRoot) (fs.File, error) {
+	path := c.path(merkle)
+
+	if f, err := os.Open(path); err == nil {
+		return f, nil
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, err
+	}
+
+	src, err := blobStore.OpenBlob(ctx, nil, merkle)
+	if err != nil {
+		return nil, err
+	}
+	defer src.Close()
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".tmp-delivery-blob-*")
+	if err != nil {
+		return nil, err
+	}
+	tmpPath := tmp.Name()
+	defer os.Remove(tmpPath)
+
+	if err := writeDeliveryBlobType1(tmp, src); err != nil {
+		tmp.Close()
+		return nil, err
+	}
+	if err := tmp.Close(); err != nil {
+		return nil, err
+	}
+
+	if err := os.Rename(tmpPath, path); err != nil {
+		return nil, err
+	}
+
+	return os.Open(path)
+}
+
+// deliveryBlobType1ChunkSize is the uncompressed size of each zstd frame in
+// a type 1 delivery blob. Chunking keeps memory bounded for large blobs and
+// lets a reader decompress (or skip) one chunk at a time instead of the
+// whole blob, using the chunk index (see deliveryBlobType1IndexEntry) to
+// find each chunk's bytes.
+const deliveryBlobType1ChunkSize = 128 * 1024
+
+// deliveryBlobType1Magic identifies the start of a type 1 delivery blob
+// produced by writeDeliveryBlobType1.
+var deliveryBlobType1Magic = [8]byte{'f', 'c', 'h', 's', 'd', 'b', '0', '1'}
+
+// deliveryBlobType1HeaderLen is the size in bytes of the fixed header
+// written by writeDeliveryBlobType1: magic, delivery blob type, and
+// uncompressed payload length.
+const deliveryBlobType1HeaderLen = 8 + 4 + 8
+
+// deliveryBlobType1IndexEntryLen is the size in bytes of one
+// deliveryBlobType1IndexEntry as written to disk.
+const deliveryBlobType1IndexEntryLen = 8 + 8 + 8
+
+// deliveryBlobType1FooterLen is the size in bytes of the trailing footer:
+// the byte offset of the chunk index from the start of the file, and the
+// number of entries in it.
+const deliveryBlobType1FooterLen = 8 + 8
+
+// deliveryBlobType1IndexEntry locates one independently-decompressable
+// zstd frame within a type 1 delivery blob, so a reader can seek to an
+// arbitrary uncompressed offset without decompressing everything before
+// it.
+type deliveryBlobType1IndexEntry struct {
+	UncompressedOffset uint64
+	CompressedOffset   uint64
+	CompressedLength   uint64
+}
+
+// countingWriter wraps a writer, tracking how many bytes have been written
+// through it so far.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// writeDeliveryBlobType1 reads the uncompressed contents of src and writes
+// them to w as a type 1 delivery blob: a header naming the magic, type and
+// uncompressed payload length; the payload split into
+// deliveryBlobType1ChunkSize-sized chunks, each compressed as its own
+// independent zstd frame; and a trailing chunk index (plus a footer
+// pointing at it) so a reader can locate and decompress any chunk on its
+// own.
+func writeDeliveryBlobType1(w io.Writer, src fs.File) error {
+	info, err := src.Stat()
+	if err != nil {
+		return err
+	}
+
+	var header [deliveryBlobType1HeaderLen]byte
+	copy(header[0:8], deliveryBlobType1Magic[:])
+	binary.LittleEndian.PutUint32(header[8:12], deliveryBlobTypeCompressed)
+	binary.LittleEndian.PutUint64(header[12:20], uint64(info.Size()))
+	if _, err := w.Write(header[:]); err != nil {
+		return err
+	}
+
+	cw := &countingWriter{w: w}
+	var index []deliveryBlobType1IndexEntry
+
+	buf := make([]byte, deliveryBlobType1ChunkSize)
+	var uncompressedOffset uint64
+	for {
+		n, err := io.ReadFull(src, buf)
+		if n > 0 {
+			chunkStart := cw.n
+
+			// A fresh *zstd.Encoder per chunk, fully closed before moving on
+			// to the next one, is what makes each chunk its own independent
+			// zstd frame: decompressing chunk i never requires the bytes of
+			// any other chunk.
+			enc, encErr := zstd.NewWriter(cw)
+			if encErr != nil {
+				return encErr
+			}
+			if _, werr := enc.Write(buf[:n]); werr != nil {
+				enc.Close()
+				return werr
+			}
+			if cerr := enc.Close(); cerr != nil {
+				return cerr
+			}
+
+			index = append(index, deliveryBlobType1IndexEntry{
+				UncompressedOffset: uncompressedOffset,
+				// CompressedOffset is relative to the start of the file (not
+				// the start of the chunk area), since that's what
+				// readDeliveryBlobType1 seeks to directly.
+				CompressedOffset: uint64(deliveryBlobType1HeaderLen + chunkStart),
+				CompressedLength: uint64(cw.n - chunkStart),
+			})
+			uncompressedOffset += uint64(n)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	indexOffset := uint64(deliveryBlobType1HeaderLen) + uint64(cw.n)
+	for _, entry := range index {
+		var raw [deliveryBlobType1IndexEntryLen]byte
+		binary.LittleEndian.PutUint64(raw[0:8], entry.UncompressedOffset)
+		binary.LittleEndian.PutUint64(raw[8:16], entry.CompressedOffset)
+		binary.LittleEndian.PutUint64(raw[16:24], entry.CompressedLength)
+		if _, err := w.Write(raw[:]); err != nil {
+			return err
+		}
+	}
+
+	var footer [deliveryBlobType1FooterLen]byte
+	binary.LittleEndian.PutUint64(footer[0:8], indexOffset)
+	binary.LittleEndian.PutUint64(footer[8:16], uint64(len(index)))
+	_, err = w.Write(footer[:])
+	return err
+}
+
+// readDeliveryBlobType1 decodes a type 1 delivery blob previously produced
+// by writeDeliveryBlobType1, using its chunk index to decompress each
+// chunk independently, and returns the reassembled uncompressed contents.
+// Nothing in this package serves decoded bytes over HTTP — that's the
+// client's job — this exists so tests can round-trip writeDeliveryBlobType1's
+// output and verify it's actually chunked and seekable.
+func readDeliveryBlobType1(r io.ReaderAt, size int64) ([]byte, error) {
+	if size < deliveryBlobType1HeaderLen+deliveryBlobType1FooterLen {
+		return nil, fmt.Errorf("delivery blob too small: %d bytes", size)
+	}
+
+	var header [deliveryBlobType1HeaderLen]byte
+	if _, err := r.ReadAt(header[:], 0); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(header[0:8], deliveryBlobType1Magic[:]) {
+		return nil, fmt.Errorf("bad delivery blob magic")
+	}
+	if deliveryBlobType := binary.LittleEndian.Uint32(header[8:12]); deliveryBlobType != deliveryBlobTypeCompressed {
+		return nil, fmt.Errorf("unexpected delivery blob type %d", deliveryBlobType)
+	}
+	uncompressedLen := binary.LittleEndian.Uint64(header[12:20])
+
+	var footer [deliveryBlobType1FooterLen]byte
+	if _, err := r.ReadAt(footer[:], size-deliveryBlobType1FooterLen); err != nil {
+		return nil, err
+	}
+	indexOffset := binary.LittleEndian.Uint64(footer[0:8])
+	entryCount := binary.LittleEndian.Uint64(footer[8:16])
+
+	indexBytes := make([]byte, entryCount*deliveryBlobType1IndexEntryLen)
+	if _, err := r.ReadAt(indexBytes, int64(indexOffset)); err != nil {
+		return nil, err
+	}
+
+	out := make([]byte, uncompressedLen)
+	for i := uint64(0); i < entryCount; i++ {
+		raw := indexBytes[i*deliveryBlobType1IndexEntryLen : (i+1)*deliveryBlobType1IndexEntryLen]
+		uncompressedOffset := binary.LittleEndian.Uint64(raw[0:8])
+		compressedOffset := binary.LittleEndian.Uint64(raw[8:16])
+		compressedLength := binary.LittleEndian.Uint64(raw[16:24])
+
+		compressed := make([]byte, compressedLength)
+		if _, err := r.ReadAt(compressed, int64(compressedOffset)); err != nil {
+			return nil, err
+		}
+
+		dec, err := zstd.NewReader(bytes.NewReader(compressed))
+		if err != nil {
+			return nil, err
+		}
+		chunk, err := io.ReadAll(dec)
+		dec.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		copy(out[uncompressedOffset:], chunk)
+	}
+
+	return out, nil
 }
 
-func newServer(
-	ctx context.Context,
-	dir string,
-	blobStore BlobStore,
-	localHostname string,
-	repoName string,
-	repoPort int,
-) (*Server, error) {
-	listener, err := net.Listen("tcp", ":"+strconv.Itoa(repoPort))
+// NewServer starts serving the TUF repository and blob store described by
+// cfg, returning a handle that can be used to inspect or shut down the
+// server.
+func NewServer(ctx context.Context, cfg ServerConfig) (*Server, error) {
+	return newServer(ctx, cfg)
+}
+
+func newServer(ctx context.Context, cfg ServerConfig) (*Server, error) {
+	dir := cfg.Dir
+	blobStore := cfg.BlobStore
+	localHostname := cfg.LocalHostname
+	repoName := cfg.RepoName
+
+	tlsConfig := cfg.TLSConfig
+	useHTTPS := cfg.UseHTTPS || tlsConfig != nil
+	if useHTTPS && tlsConfig == nil {
+		var err error
+		tlsConfig, err = generateSelfSignedTLSConfig(localHostname)
+		if err != nil {
+			return nil, fmt.Errorf("failed to generate self-signed certificate: %w", err)
+		}
+	}
+
+	listener, err := net.Listen("tcp", ":"+strconv.Itoa(cfg.RepoPort))
 	if err != nil {
 		return nil, err
 	}
 
+	if tlsConfig != nil {
+		listener = tls.NewListener(listener, tlsConfig)
+	}
+
 	port := listener.Addr().(*net.TCPAddr).Port
 	logger.Infof(ctx, "Serving %s on :%d", dir, port)
 
-	configURL, configHash, config, err := genConfig(dir, localHostname, repoName, port)
+	scheme := "http"
+	if tlsConfig != nil {
+		scheme = "https"
+	}
+
+	// Server.URL/Server.Hash are kept for back-compat: they render the config
+	// as seen from the hostname the caller asked us to advertise, even
+	// though the live /config.json handler below will reflect whatever
+	// name/interface the request actually came in on.
+	configURL, configHash, config, err := genConfig(dir, scheme, localHostname, repoName, port, cfg.RepoOptions)
 	if err != nil {
 		listener.Close()
 		return nil, err
@@ -101,16 +553,18 @@ func newServer(
 	logger.Infof(ctx, "%s [repo serve] config.json: %s\n",
 		time.Now().Format("2006-01-02 15:04:05"), string(config))
 
+	configHandler := newConfigHandler(dir, repoName, cfg.RepoOptions)
+
 	mux := http.NewServeMux()
-	mux.HandleFunc(fmt.Sprintf("/%s/config.json", repoName), func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(200)
-		w.Write(config)
-	})
+	mux.Handle(fmt.Sprintf("/%s/config.json", repoName), configHandler)
 	// Blobs requests come as `/blobs/<merkle>` so the directory we actually
 	// serve from should be the parent directory of the blobsDir and the blobsDir
 	// should be called `blobs`.
-	mux.Handle("/blobs/", http.FileServer(http.FS(httpBlobStore{ctx, blobStore})))
+	var deliveryBlobCache *deliveryBlobCache
+	if cfg.DeliveryBlobCacheDir != "" {
+		deliveryBlobCache = newDeliveryBlobCache(cfg.DeliveryBlobCacheDir)
+	}
+	mux.Handle("/blobs/", http.FileServer(http.FS(httpBlobStore{ctx, blobStore, deliveryBlobCache})))
 	mux.Handle("/", http.FileServer(http.Dir(dir)))
 
 	server := &http.Server{
@@ -139,6 +593,8 @@ func newServer(
 		}
 	}()
 
+	go watchMetadata(ctx, shuttingDown, dir, configHandler)
+
 	return &Server{
 		Dir:          dir,
 		BlobStore:    blobStore,
@@ -164,90 +620,117 @@ func (lw *loggingWriter) WriteHeader(status int) {
 	lw.ResponseWriter.WriteHeader(status)
 }
 
-// writeConfig writes the source config to the repository.
-func genConfig(dir string, localHostname string, repoName string, port int) (configURL string, configHash string, config []byte, err error) {
-	type repositoryStorageType string
-
-	type keyConfig struct {
-		Type  string `json:"type"`
-		Value string `json:"value"`
-	}
-
-	getRootKeys := func(root *tuf_data.Root) ([]keyConfig, error) {
-		rootKeys := make(map[string]struct{})
-		if role, ok := root.Roles["root"]; ok {
-			for _, id := range role.KeyIDs {
-				if key, ok := root.Keys[id]; ok {
-					switch key.Type {
-					case tuf_data.KeyTypeEd25519:
-						var kv struct {
-							Public tuf_data.HexBytes `json:"public"`
-						}
-						if err := json.Unmarshal(key.Value, &kv); err != nil {
-							return nil, fmt.Errorf("failed to unmarshal key: %w", err)
-						}
-						rootKeys[kv.Public.String()] = struct{}{}
-					default:
-						return nil, fmt.Errorf("unexpected key type: %q", key.Type)
+type repositoryStorageType string
+
+type keyConfig struct {
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+type mirrorConfig struct {
+	MirrorURL string `json:"mirror_url"`
+	Subscribe bool   `json:"subscribe"`
+	BlobURL   string `json:"blob_mirror_url,omitempty"`
+}
+
+type repositoryConfig struct {
+	RepoURL          string                `json:"repo_url"`
+	RootKeys         []keyConfig           `json:"root_keys"`
+	Mirrors          []mirrorConfig        `json:"mirrors"`
+	RootVersion      uint32                `json:"root_version"`
+	RootThreshold    uint32                `json:"root_threshold"`
+	UpdatePackageURL string                `json:"update_package_url,omitempty"`
+	UseLocalMirror   bool                  `json:"use_local_mirror,omitempty"`
+	StorageType      repositoryStorageType `json:"storage_type,omitempty"`
+}
+
+// rootMetadata is the subset of root.json we need to answer a config.json
+// request. Reading and parsing root.json is the expensive part of
+// generating a config, so it's cached by ConfigHandler across requests.
+type rootMetadata struct {
+	rootKeys      []keyConfig
+	rootVersion   uint32
+	rootThreshold uint32
+}
+
+func getRootKeys(root *tuf_data.Root) ([]keyConfig, error) {
+	rootKeys := make(map[string]struct{})
+	if role, ok := root.Roles["root"]; ok {
+		for _, id := range role.KeyIDs {
+			if key, ok := root.Keys[id]; ok {
+				switch key.Type {
+				case tuf_data.KeyTypeEd25519:
+					var kv struct {
+						Public tuf_data.HexBytes `json:"public"`
+					}
+					if err := json.Unmarshal(key.Value, &kv); err != nil {
+						return nil, fmt.Errorf("failed to unmarshal key: %w", err)
 					}
+					rootKeys[kv.Public.String()] = struct{}{}
+				default:
+					return nil, fmt.Errorf("unexpected key type: %q", key.Type)
 				}
 			}
 		}
-		rootKeyConfigs := make([]keyConfig, 0, len(rootKeys))
-		for key := range rootKeys {
-			rootKeyConfigs = append(rootKeyConfigs, keyConfig{"ed25519", key})
-		}
-		return rootKeyConfigs, nil
-	}
-
-	type mirrorConfig struct {
-		MirrorURL string `json:"mirror_url"`
-		Subscribe bool   `json:"subscribe"`
-		BlobURL   string `json:"blob_mirror_url,omitempty"`
 	}
-
-	type repositoryConfig struct {
-		RepoURL          string                `json:"repo_url"`
-		RootKeys         []keyConfig           `json:"root_keys"`
-		Mirrors          []mirrorConfig        `json:"mirrors"`
-		RootVersion      uint32                `json:"root_version"`
-		RootThreshold    uint32                `json:"root_threshold"`
-		UpdatePackageURL string                `json:"update_package_url,omitempty"`
-		UseLocalMirror   bool                  `json:"use_local_mirror,omitempty"`
-		StorageType      repositoryStorageType `json:"storage_type,omitempty"`
+	rootKeyConfigs := make([]keyConfig, 0, len(rootKeys))
+	for key := range rootKeys {
+		rootKeyConfigs = append(rootKeyConfigs, keyConfig{"ed25519", key})
 	}
+	return rootKeyConfigs, nil
+}
 
+// parseRootMetadata reads and parses root.json in dir, returning the root
+// keys and versioning info needed to build a repositoryConfig. Its
+// signatures are not checked.
+func parseRootMetadata(dir string) (*rootMetadata, error) {
 	f, err := os.Open(filepath.Join(dir, "root.json"))
 	if err != nil {
-		return "", "", nil, err
+		return nil, err
 	}
 	defer f.Close()
 
 	var signed tuf_data.Signed
 	if err := json.NewDecoder(f).Decode(&signed); err != nil {
-		return "", "", nil, err
+		return nil, err
 	}
 
 	var root tuf_data.Root
 	if err := json.Unmarshal(signed.Signed, &root); err != nil {
-		return "", "", nil, err
+		return nil, err
 	}
 
 	rootKeys, err := getRootKeys(&root)
 	if err != nil {
-		return "", "", nil, err
+		return nil, err
 	}
 
-	hostname := strings.ReplaceAll(localHostname, "%", "%25")
+	var rootThreshold int
+	if rootRole, ok := root.Roles["root"]; ok {
+		rootThreshold = rootRole.Threshold
+	}
+
+	return &rootMetadata{
+		rootKeys:      rootKeys,
+		rootVersion:   uint32(root.Version),
+		rootThreshold: uint32(rootThreshold),
+	}, nil
+}
 
-	var mirrorURL string
+// formatMirrorURL joins a scheme, hostname and port into a mirror URL,
+// bracketing the hostname if it's an IPv6 literal.
+func formatMirrorURL(scheme string, hostname string, port int) string {
+	hostname = strings.ReplaceAll(hostname, "%", "%25")
 	if strings.Contains(hostname, ":") {
-		// This is an IPv6 address, use brackets for an IPv6 literal
-		mirrorURL = fmt.Sprintf("http://[%s]:%d", hostname, port)
-	} else {
-		mirrorURL = fmt.Sprintf("http://%s:%d", hostname, port)
+		// This is an IPv6 address, use brackets for an IPv6 literal.
+		return fmt.Sprintf("%s://[%s]:%d", scheme, hostname, port)
 	}
+	return fmt.Sprintf("%s://%s:%d", scheme, hostname, port)
+}
 
+// buildRepositoryConfig assembles the repositoryConfig served as
+// config.json for a mirror reachable at mirrorURL.
+func buildRepositoryConfig(root *rootMetadata, repoName string, mirrorURL string, opts RepoOptions) *repositoryConfig {
 	mirror := []mirrorConfig{
 		{
 			MirrorURL: mirrorURL,
@@ -256,22 +739,35 @@ func genConfig(dir string, localHostname string, repoName string, port int) (con
 		},
 	}
 
-	configURL = fmt.Sprintf("%s/%s/config.json", mirrorURL, repoName)
+	storageType := opts.StorageType
+	if storageType == "" {
+		storageType = StorageTypeEphemeral
+	}
 
-	var rootThreshold int
-	if rootRole, ok := root.Roles["root"]; ok {
-		rootThreshold = rootRole.Threshold
+	return &repositoryConfig{
+		RepoURL:          fmt.Sprintf("fuchsia-pkg://%s", repoName),
+		RootKeys:         root.rootKeys,
+		Mirrors:          mirror,
+		RootVersion:      root.rootVersion,
+		RootThreshold:    root.rootThreshold,
+		UpdatePackageURL: opts.UpdatePackageURL,
+		UseLocalMirror:   opts.UseLocalMirror,
+		StorageType:      storageType,
+	}
+}
+
+// genConfig renders the config.json for a mirror at scheme://localHostname:port,
+// returning the URL it is served at, its SHA-256 hash and its bytes.
+func genConfig(dir string, scheme string, localHostname string, repoName string, port int, opts RepoOptions) (configURL string, configHash string, config []byte, err error) {
+	root, err := parseRootMetadata(dir)
+	if err != nil {
+		return "", "", nil, err
 	}
 
-	config, err = json.Marshal(&repositoryConfig{
-		RepoURL:        fmt.Sprintf("fuchsia-pkg://%s", repoName),
-		RootKeys:       rootKeys,
-		Mirrors:        mirror,
-		RootVersion:    uint32(root.Version),
-		RootThreshold:  uint32(rootThreshold),
-		UseLocalMirror: false,
-		StorageType:    "ephemeral",
-	})
+	mirrorURL := formatMirrorURL(scheme, localHostname, port)
+	configURL = fmt.Sprintf("%s/%s/config.json", mirrorURL, repoName)
+
+	config, err = json.Marshal(buildRepositoryConfig(root, repoName, mirrorURL, opts))
 	if err != nil {
 		return "", "", nil, err
 	}
@@ -280,3 +776,168 @@ func genConfig(dir string, localHostname string, repoName string, port int) (con
 
 	return configURL, configHash, config, nil
 }
+
+// ConfigHandler serves config.json, regenerating the repositoryConfig on
+// every request from the incoming request's scheme and Host rather than
+// baking in whatever hostname the server was started with. This lets the
+// same server be reached through multiple names/interfaces, e.g. through a
+// port-forward, and still hand back a mirror URL the client can use.
+//
+// Reading and parsing root.json is cached across requests, since it only
+// changes when the repository is re-keyed.
+type ConfigHandler struct {
+	dir         string
+	repoName    string
+	repoOptions RepoOptions
+
+	mu   sync.Mutex
+	root *rootMetadata
+}
+
+func newConfigHandler(dir string, repoName string, opts RepoOptions) *ConfigHandler {
+	return &ConfigHandler{dir: dir, repoName: repoName, repoOptions: opts}
+}
+
+// invalidate drops the cached root metadata, forcing the next request to
+// re-read and re-parse root.json.
+func (h *ConfigHandler) invalidate() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.root = nil
+}
+
+func (h *ConfigHandler) rootMetadata() (*rootMetadata, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.root != nil {
+		return h.root, nil
+	}
+
+	root, err := parseRootMetadata(h.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	h.root = root
+	return root, nil
+}
+
+func (h *ConfigHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	root, err := h.rootMetadata()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	mirrorURL := fmt.Sprintf("%s://%s", scheme, r.Host)
+
+	config, err := json.Marshal(buildRepositoryConfig(root, h.repoName, mirrorURL, h.repoOptions))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(config)
+}
+
+// generateSelfSignedTLSConfig creates an in-process self-signed certificate
+// for hostname, so tests can request an HTTPS mirror without provisioning a
+// CA-signed cert.
+func generateSelfSignedTLSConfig(hostname string) (*tls.Config, error) {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate key: %w", err)
+	}
+
+	serialNumberLimit := new(big.Int).Lsh(big.NewInt(1), 128)
+	serialNumber, err := rand.Int(rand.Reader, serialNumberLimit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate serial number: %w", err)
+	}
+
+	template := x509.Certificate{
+		SerialNumber: serialNumber,
+		Subject: pkix.Name{
+			Organization: []string{"Fuchsia host-target-testing"},
+		},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		KeyUsage:              x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+
+	if ip := net.ParseIP(hostname); ip != nil {
+		template.IPAddresses = append(template.IPAddresses, ip)
+	} else {
+		template.DNSNames = append(template.DNSNames, hostname)
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &priv.PublicKey, priv)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create certificate: %w", err)
+	}
+
+	cert := tls.Certificate{
+		Certificate: [][]byte{der},
+		PrivateKey:  priv,
+	}
+
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+	}, nil
+}
+
+// watchedMetadataFiles are the TUF roles that change every time a new
+// repository version is published. A change to any of them may mean
+// root.json was rotated too, so they're used as the trigger to invalidate
+// cached parses rather than being parsed themselves.
+var watchedMetadataFiles = []string{"timestamp.json", "snapshot.json", "targets.json"}
+
+// metadataPollInterval is how often watchMetadata checks the TUF metadata
+// files on disk for changes.
+const metadataPollInterval = time.Second
+
+// watchMetadata polls dir's TUF metadata for changes and invalidates
+// configHandler's cached root metadata whenever it sees one, so a
+// republished repository (including a rotated root key) is picked up by
+// the next config.json request instead of being served stale forever.
+func watchMetadata(ctx context.Context, shuttingDown <-chan struct{}, dir string, configHandler *ConfigHandler) {
+	lastModTimes := make([]time.Time, len(watchedMetadataFiles))
+
+	ticker := time.NewTicker(metadataPollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-shuttingDown:
+			return
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		changed := false
+		for i, name := range watchedMetadataFiles {
+			info, err := os.Stat(filepath.Join(dir, name))
+			if err != nil {
+				continue
+			}
+			if !info.ModTime().Equal(lastModTimes[i]) {
+				lastModTimes[i] = info.ModTime()
+				changed = true
+			}
+		}
+
+		if changed {
+			configHandler.invalidate()
+		}
+	}
+}
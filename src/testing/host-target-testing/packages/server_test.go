@@ -0,0 +1,516 @@
+// Copyright 2019 The Fuchsia Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package packages
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	tuf_data "github.com/theupdateframework/go-tuf/data"
+
+	"go.fuchsia.dev/fuchsia/src/testing/host-target-testing/build"
+)
+
+func TestBuildRepositoryConfigDefaultsStorageType(t *testing.T) {
+	root := &rootMetadata{rootVersion: 1, rootThreshold: 1}
+
+	cfg := buildRepositoryConfig(root, "devhost", "http://example:8080", RepoOptions{})
+
+	if cfg.StorageType != StorageTypeEphemeral {
+		t.Errorf("got storage type %q, want %q", cfg.StorageType, StorageTypeEphemeral)
+	}
+	if cfg.UseLocalMirror {
+		t.Errorf("got UseLocalMirror = true, want false")
+	}
+	if cfg.UpdatePackageURL != "" {
+		t.Errorf("got update package url %q, want empty", cfg.UpdatePackageURL)
+	}
+}
+
+func TestBuildRepositoryConfigHonorsRepoOptions(t *testing.T) {
+	root := &rootMetadata{rootVersion: 1, rootThreshold: 1}
+
+	opts := RepoOptions{
+		StorageType:      StorageTypePersistent,
+		UseLocalMirror:   true,
+		UpdatePackageURL: "fuchsia-pkg://fuchsia.com/update",
+	}
+
+	cfg := buildRepositoryConfig(root, "devhost", "http://example:8080", opts)
+
+	if cfg.StorageType != StorageTypePersistent {
+		t.Errorf("got storage type %q, want %q", cfg.StorageType, StorageTypePersistent)
+	}
+	if !cfg.UseLocalMirror {
+		t.Errorf("got UseLocalMirror = false, want true")
+	}
+	if cfg.UpdatePackageURL != opts.UpdatePackageURL {
+		t.Errorf("got update package url %q, want %q", cfg.UpdatePackageURL, opts.UpdatePackageURL)
+	}
+}
+
+// writeTestRootJSON writes a minimal, well-formed root.json into dir so
+// parseRootMetadata can load it.
+func writeTestRootJSON(t *testing.T, dir string) {
+	t.Helper()
+
+	root := tuf_data.Root{
+		Version: 3,
+		Roles: map[string]*tuf_data.Role{
+			"root": {KeyIDs: []string{"key1"}, Threshold: 1},
+		},
+		Keys: map[string]*tuf_data.PublicKey{
+			"key1": {
+				Type:  tuf_data.KeyTypeEd25519,
+				Value: json.RawMessage(`{"public":"aabbcc"}`),
+			},
+		},
+	}
+
+	signedRoot, err := json.Marshal(root)
+	if err != nil {
+		t.Fatalf("failed to marshal root: %s", err)
+	}
+
+	signed, err := json.Marshal(tuf_data.Signed{Signed: signedRoot})
+	if err != nil {
+		t.Fatalf("failed to marshal signed root: %s", err)
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, "root.json"), signed, 0o644); err != nil {
+		t.Fatalf("failed to write root.json: %s", err)
+	}
+}
+
+func TestConfigHandlerReflectsRequestHost(t *testing.T) {
+	dir := t.TempDir()
+	writeTestRootJSON(t, dir)
+
+	h := newConfigHandler(dir, "devhost", RepoOptions{})
+
+	for _, tc := range []struct {
+		name     string
+		host     string
+		useTLS   bool
+		wantBase string
+	}{
+		{"http via first hostname", "host-a:8080", false, "http://host-a:8080"},
+		{"http via a different hostname", "host-b:9000", false, "http://host-b:9000"},
+		{"https", "host-a:8443", true, "https://host-a:8443"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/devhost/config.json", nil)
+			req.Host = tc.host
+			if tc.useTLS {
+				req.TLS = &tls.ConnectionState{}
+			}
+
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, req)
+
+			if w.Code != http.StatusOK {
+				t.Fatalf("got status %d, want %d: %s", w.Code, http.StatusOK, w.Body.String())
+			}
+
+			var cfg repositoryConfig
+			if err := json.Unmarshal(w.Body.Bytes(), &cfg); err != nil {
+				t.Fatalf("failed to decode config.json: %s", err)
+			}
+
+			if len(cfg.Mirrors) != 1 {
+				t.Fatalf("got %d mirrors, want 1", len(cfg.Mirrors))
+			}
+			if got := cfg.Mirrors[0].MirrorURL; got != tc.wantBase {
+				t.Errorf("got mirror_url %q, want %q", got, tc.wantBase)
+			}
+			if got, want := cfg.Mirrors[0].BlobURL, tc.wantBase+"/blobs"; got != want {
+				t.Errorf("got blob_mirror_url %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestServeOverHTTPS(t *testing.T) {
+	dir := t.TempDir()
+	writeTestRootJSON(t, dir)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	server, err := newServer(ctx, ServerConfig{
+		Dir:           dir,
+		BlobStore:     &fakeBlobStore{},
+		LocalHostname: "127.0.0.1",
+		RepoName:      "devhost",
+		UseHTTPS:      true,
+	})
+	if err != nil {
+		t.Fatalf("newServer() = %s", err)
+	}
+	defer server.Shutdown(ctx)
+
+	// The server presents a self-signed certificate that's never exposed
+	// anywhere for a caller to pin, so the client has to explicitly opt out
+	// of verifying it, same as pkg-resolver would need to if it ever talked
+	// to one of these servers directly over HTTPS.
+	client := &http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		},
+	}
+
+	resp, err := client.Get(server.URL)
+	if err != nil {
+		t.Fatalf("failed to fetch %s: %s", server.URL, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("got status %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+
+	var cfg repositoryConfig
+	if err := json.NewDecoder(resp.Body).Decode(&cfg); err != nil {
+		t.Fatalf("failed to decode config.json: %s", err)
+	}
+
+	if len(cfg.Mirrors) != 1 {
+		t.Fatalf("got %d mirrors, want 1", len(cfg.Mirrors))
+	}
+	if got := cfg.Mirrors[0].MirrorURL; !strings.HasPrefix(got, "https://") {
+		t.Errorf("got mirror_url %q, want an https:// URL", got)
+	}
+}
+
+func TestWriteDeliveryBlobType1RoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	blobPath := filepath.Join(dir, "blob")
+
+	// Large enough, and irregular enough, to span several
+	// deliveryBlobType1ChunkSize-sized chunks with a short final chunk.
+	want := bytes.Repeat([]byte("hello world, this is a delivery blob! "), 20000)
+	if err := os.WriteFile(blobPath, want, 0o644); err != nil {
+		t.Fatalf("failed to write test blob: %s", err)
+	}
+
+	src, err := os.Open(blobPath)
+	if err != nil {
+		t.Fatalf("failed to open test blob: %s", err)
+	}
+	defer src.Close()
+
+	var buf bytes.Buffer
+	if err := writeDeliveryBlobType1(&buf, src); err != nil {
+		t.Fatalf("writeDeliveryBlobType1() = %s", err)
+	}
+
+	got, err := readDeliveryBlobType1(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatalf("readDeliveryBlobType1() = %s", err)
+	}
+
+	if !bytes.Equal(got, want) {
+		t.Errorf("round-tripped delivery blob does not match original: got %d bytes, want %d bytes", len(got), len(want))
+	}
+}
+
+// fakeBlobStore is a BlobStore backed by an in-memory map, for testing
+// deliveryBlobCache without needing a real on-disk blob store.
+type fakeBlobStore struct {
+	blobs map[build.MerkleRoot][]byte
+}
+
+func (f *fakeBlobStore) OpenBlob(ctx context.Context, deliveryBlobType *int, merkle build.MerkleRoot) (fs.File, error) {
+	b, ok := f.blobs[merkle]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	return &memBlob{Reader: bytes.NewReader(b), size: int64(len(b))}, nil
+}
+
+func (f *fakeBlobStore) SupportsDeliveryBlobType(deliveryBlobType int) bool {
+	return deliveryBlobType == 0
+}
+
+type memBlob struct {
+	*bytes.Reader
+	size int64
+}
+
+func (m *memBlob) Stat() (fs.FileInfo, error) { return memBlobInfo{size: m.size}, nil }
+func (m *memBlob) Close() error               { return nil }
+
+type memBlobInfo struct{ size int64 }
+
+func (i memBlobInfo) Name() string       { return "blob" }
+func (i memBlobInfo) Size() int64        { return i.size }
+func (i memBlobInfo) Mode() fs.FileMode  { return 0 }
+func (i memBlobInfo) ModTime() time.Time { return time.Time{} }
+func (i memBlobInfo) IsDir() bool        { return false }
+func (i memBlobInfo) Sys() interface{}   { return nil }
+
+func TestDeliveryBlobCacheOpenOrCompressRoundTrip(t *testing.T) {
+	want := bytes.Repeat([]byte("cached delivery blob contents, "), 10000)
+
+	var merkle build.MerkleRoot
+	merkle[0] = 0x42
+
+	store := &fakeBlobStore{blobs: map[build.MerkleRoot][]byte{merkle: want}}
+	cache := newDeliveryBlobCache(t.TempDir())
+
+	f, err := cache.openOrCompress(context.Background(), store, merkle)
+	if err != nil {
+		t.Fatalf("openOrCompress() = %s", err)
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		t.Fatalf("Stat() = %s", err)
+	}
+
+	readerAt, ok := f.(io.ReaderAt)
+	if !ok {
+		t.Fatalf("cached delivery blob file does not implement io.ReaderAt")
+	}
+
+	got, err := readDeliveryBlobType1(readerAt, info.Size())
+	if err != nil {
+		t.Fatalf("readDeliveryBlobType1() = %s", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("cached delivery blob does not round-trip: got %d bytes, want %d bytes", len(got), len(want))
+	}
+
+	// A second request for the same (type, merkle) should be served from
+	// the cache rather than recompressed, so it should succeed even if the
+	// backing store can no longer produce the uncompressed blob.
+	delete(store.blobs, merkle)
+	f2, err := cache.openOrCompress(context.Background(), store, merkle)
+	if err != nil {
+		t.Fatalf("openOrCompress() (cache hit) = %s", err)
+	}
+	f2.Close()
+}
+
+func TestSeekableFileSeek(t *testing.T) {
+	data := []byte("0123456789")
+	sf := &seekableFile{readerAt: bytes.NewReader(data), size: int64(len(data))}
+
+	for _, tc := range []struct {
+		name        string
+		startOffset int64
+		offset      int64
+		whence      int
+		want        int64
+		wantErr     bool
+	}{
+		{"seek start", 5, 3, io.SeekStart, 3, false},
+		{"seek current", 5, 2, io.SeekCurrent, 7, false},
+		{"seek end", 0, -2, io.SeekEnd, 8, false},
+		{"negative resulting offset", 0, -1, io.SeekStart, 0, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			sf.offset = tc.startOffset
+
+			got, err := sf.Seek(tc.offset, tc.whence)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("Seek(%d, %d) = %d, nil, want an error", tc.offset, tc.whence, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Seek(%d, %d) = %s", tc.offset, tc.whence, err)
+			}
+			if got != tc.want {
+				t.Errorf("Seek(%d, %d) = %d, want %d", tc.offset, tc.whence, got, tc.want)
+			}
+		})
+	}
+}
+
+// readerAtOnlyBlob is an fs.File that implements io.ReaderAt but not
+// io.Seeker, modeling a BlobStore whose blobs can only be read at an
+// offset, to exercise asSeekableFile's wrapping path end-to-end through the
+// real HTTP mux rather than calling seekableFile directly.
+type readerAtOnlyBlob struct {
+	data []byte
+}
+
+func (r *readerAtOnlyBlob) ReadAt(p []byte, off int64) (int, error) {
+	if off >= int64(len(r.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, r.data[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (r *readerAtOnlyBlob) Read(p []byte) (int, error) {
+	return 0, errors.New("readerAtOnlyBlob: Read unused, asSeekableFile should only use ReadAt")
+}
+
+func (r *readerAtOnlyBlob) Stat() (fs.FileInfo, error) {
+	return memBlobInfo{size: int64(len(r.data))}, nil
+}
+
+func (r *readerAtOnlyBlob) Close() error { return nil }
+
+type readerAtOnlyBlobStore struct {
+	data []byte
+}
+
+func (s *readerAtOnlyBlobStore) OpenBlob(ctx context.Context, deliveryBlobType *int, merkle build.MerkleRoot) (fs.File, error) {
+	return &readerAtOnlyBlob{data: s.data}, nil
+}
+
+func (s *readerAtOnlyBlobStore) SupportsDeliveryBlobType(deliveryBlobType int) bool {
+	return false
+}
+
+func TestRangeRequestAgainstReaderAtOnlyBlob(t *testing.T) {
+	dir := t.TempDir()
+	writeTestRootJSON(t, dir)
+
+	want := []byte("the quick brown fox jumps over the lazy dog")
+	var merkle build.MerkleRoot
+	merkle[0] = 0x7a
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	server, err := newServer(ctx, ServerConfig{
+		Dir:           dir,
+		BlobStore:     &readerAtOnlyBlobStore{data: want},
+		LocalHostname: "127.0.0.1",
+		RepoName:      "devhost",
+	})
+	if err != nil {
+		t.Fatalf("newServer() = %s", err)
+	}
+	defer server.Shutdown(ctx)
+
+	mirrorURL := strings.TrimSuffix(server.URL, "/devhost/config.json")
+	blobURL := fmt.Sprintf("%s/blobs/%s", mirrorURL, hex.EncodeToString(merkle[:]))
+
+	req, err := http.NewRequest(http.MethodGet, blobURL, nil)
+	if err != nil {
+		t.Fatalf("failed to build request: %s", err)
+	}
+	req.Header.Set("Range", "bytes=4-8")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("failed to fetch %s: %s", blobURL, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusPartialContent {
+		t.Fatalf("got status %d, want %d", resp.StatusCode, http.StatusPartialContent)
+	}
+
+	got, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("failed to read response body: %s", err)
+	}
+	if wantRange := want[4:9]; !bytes.Equal(got, wantRange) {
+		t.Errorf("got range body %q, want %q", got, wantRange)
+	}
+}
+
+// rotateTestRootJSON overwrites root.json in dir with a new version and a
+// different root key, simulating a republished, re-keyed repository.
+func rotateTestRootJSON(t *testing.T, dir string) {
+	t.Helper()
+
+	root := tuf_data.Root{
+		Version: 4,
+		Roles: map[string]*tuf_data.Role{
+			"root": {KeyIDs: []string{"key2"}, Threshold: 1},
+		},
+		Keys: map[string]*tuf_data.PublicKey{
+			"key2": {
+				Type:  tuf_data.KeyTypeEd25519,
+				Value: json.RawMessage(`{"public":"ddeeff"}`),
+			},
+		},
+	}
+
+	signedRoot, err := json.Marshal(root)
+	if err != nil {
+		t.Fatalf("failed to marshal root: %s", err)
+	}
+
+	signed, err := json.Marshal(tuf_data.Signed{Signed: signedRoot})
+	if err != nil {
+		t.Fatalf("failed to marshal signed root: %s", err)
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, "root.json"), signed, 0o644); err != nil {
+		t.Fatalf("failed to write root.json: %s", err)
+	}
+}
+
+func TestWatchMetadataInvalidatesCacheOnMetadataChange(t *testing.T) {
+	dir := t.TempDir()
+	writeTestRootJSON(t, dir)
+
+	h := newConfigHandler(dir, "devhost", RepoOptions{})
+
+	// Populate the cache with the original root.json before watchMetadata
+	// starts, the same way the first config.json request would.
+	if root, err := h.rootMetadata(); err != nil {
+		t.Fatalf("rootMetadata() = %s", err)
+	} else if root.rootVersion != 3 {
+		t.Fatalf("got root version %d, want 3", root.rootVersion)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	shuttingDown := make(chan struct{})
+	defer close(shuttingDown)
+
+	go watchMetadata(ctx, shuttingDown, dir, h)
+
+	// Republish: rotate root.json, then touch one of the watched metadata
+	// files, the same way a new repository version would update them
+	// together.
+	rotateTestRootJSON(t, dir)
+	if err := os.WriteFile(filepath.Join(dir, "timestamp.json"), []byte("{}"), 0o644); err != nil {
+		t.Fatalf("failed to write timestamp.json: %s", err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		root, err := h.rootMetadata()
+		if err != nil {
+			t.Fatalf("rootMetadata() = %s", err)
+		}
+		if root.rootVersion == 4 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("ConfigHandler still serving root version %d after %s, watchMetadata never invalidated the cache", root.rootVersion, 5*time.Second)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}